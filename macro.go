@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -18,72 +19,251 @@ import (
 // 加y个月，减z天，加p小时，减q秒，最后按照var的输出格式输出，如：
 // 业务时间=2018-01-01，${date+1+2m}=20180302，${date-1m}=20171201
 // 月级别任务常量配置推荐使用${var-1m}，可支持跨年场景；
+// 周级别偏移使用w后缀，如${date+2w-1d}表示先加14天再减1天；
+// ${week_of_year}输出ISO周数（01~53），${weekday}/${WEEKDAY}输出星期几（英文全称/数字，0~6，0为周日）；
 // 获取任意月份最后一天：利用${last_date+N}、${last_DATE+N}和${last_day+N} 可获取任意月份的最后一天，以2019-02-21执行结果为例：
 // ${last_DATE} = 2019-02-28
 // ${last_DATE-1} = 2019-01-31
 // ${last_date+1} = 20190331
 // ${last_day} = 28
+//
+// 如果内置宏的输出格式不满足需求，可以用 ${fmt:<Go layout>} 直接内联一个
+// time.Format 布局字符串；偏移后缀需要用"|"和 layout 分隔书写，如
+// ${fmt:2006-01-02_15|+1d}，避免 layout 本身常见的数字时区（如 -0700）被
+// 误当成偏移量；也可以用 ExpandTimeMacroWith 配合 FormatterRegistry
+// 注册/替换命名宏的输出格式。
+//
+// ExpandTimeMacroWithOptions 支持指定时区（Options.Location）、自定义周起始日
+// （Options.WeekStart，用于${week_of_year}）以及可注入时钟（Options.Now，供
+// ${now}/${NOW} 使用，常见于"今天零点"这类业务时间计算场景）。
+//
+// 除了${...}这种严格的宏语法外，还支持${nl:...}形式的自然语言时间表达式，如
+// ${nl:明天下午三点}、${nl:大后天 16:00}、${nl:tomorrow 3pm}、${nl:next monday}、
+// ${nl:last day of month}；可以用${nl:<表达式>|fmt:<Go layout>}指定输出格式，
+// 不指定则按${DATE}同款的yyyy-mm-dd格式输出。解析失败时原样保留${nl:...}文本，
+// 详见nl_parser.go。
 func ExpandTimeMacro(rawSQL string, t time.Time) string {
-	result := macroRegex.ReplaceAllStringFunc(rawSQL, func(match string) string {
+	return ExpandTimeMacroWith(rawSQL, t, defaultFormatterRegistry)
+}
+
+// ExpandTimeMacroWith 与 ExpandTimeMacro 行为一致，但命名宏（${DATE}、${date} 等）
+// 的输出格式从传入的 reg 中查找，而不是使用包级别的默认格式，便于调用方自定义或
+// 覆盖某个宏的展现形式。
+func ExpandTimeMacroWith(rawSQL string, t time.Time, reg *FormatterRegistry) string {
+	return expandTimeMacro(rawSQL, t, t, reg, time.Monday)
+}
+
+// ExpandTimeMacroWithOptions 与 ExpandTimeMacro 行为一致，但允许调用方通过 opts
+// 指定展开时使用的时区、周起始日以及 ${now}/${NOW} 所依赖的可注入时钟。t 会先被
+// 转换到 opts.Location 所在时区，所有偏移运算（AddDate/Add）都在该时区下进行，
+// 从而正确处理夏令时等跨时区场景。
+func ExpandTimeMacroWithOptions(rawSQL string, t time.Time, opts Options) string {
+	loc := opts.Location
+	if loc == nil {
+		loc = t.Location()
+	}
+	t = t.In(loc)
+
+	now := t
+	if opts.Now != nil {
+		now = opts.Now().In(loc)
+	}
+
+	weekStart := time.Monday
+	if opts.WeekStart != nil {
+		weekStart = *opts.WeekStart
+	}
+
+	return expandTimeMacro(rawSQL, t, now, defaultFormatterRegistry, weekStart)
+}
+
+// Options 携带 ExpandTimeMacroWithOptions 展开宏时需要的上下文。
+type Options struct {
+	// Location 指定展开宏使用的时区，nil 表示沿用传入 time.Time 自带的时区。
+	Location *time.Location
+	// WeekStart 指定一周的起始日，用于 ${week_of_year} 的周数计算；nil 表示
+	// 未设置，使用默认的 time.Monday（ISO 8601 周起始日）。time.Weekday 的零值
+	// 就是 time.Sunday，所以这里必须用指针而不是裸值作为"未设置"的哨兵，否则
+	// 调用方无法显式表达"周日开始"。
+	WeekStart *time.Weekday
+	// Now 是 ${now}/${NOW} 宏使用的可注入时钟，便于测试；为 nil 时退化为
+	// 使用传入 ExpandTimeMacroWithOptions 的业务时间 t。
+	Now func() time.Time
+}
+
+func expandTimeMacro(rawSQL string, t, now time.Time, reg *FormatterRegistry, weekStart time.Weekday) string {
+	rawSQL = expandNLMacro(rawSQL, t)
+
+	rawSQL = fmtMacroRegex.ReplaceAllStringFunc(rawSQL, func(match string) string {
+		h, layout, err := parseFmtMacro(match)
+		if err != nil {
+			return match
+		}
+		return h.offsetTime(t).Format(layout)
+	})
+
+	return macroRegex.ReplaceAllStringFunc(rawSQL, func(match string) string {
 		h, err := parseMacro(match)
 		if err != nil {
 			return match
 		}
 
-		offset := h.offsetTime(t)
-		switch h.name {
-		case dateHyperMacro:
-			return offset.Format("2006-01-02")
-		case dateMacro:
-			return offset.Format("20060102")
-		case hourXMacro:
-			return strconv.Itoa(offset.Hour())
-		case hourHHMacro:
-			return fmt.Sprintf("%02d", offset.Hour())
-		case dayDDMacro:
-			return strconv.Itoa(offset.Day())
-		case monthMacro:
-			return fmt.Sprintf("%02d", int(offset.Month()))
-		case timestampMacro:
-			return strconv.FormatInt(offset.Unix(), 10)
-		case weekOfYearMacro:
-			return fmt.Sprintf("%02d", offset.Weekday())
+		base := t
+		if h.name == nowMacro || h.name == nowHyperMacro {
+			base = now
+		}
+
+		offset := h.offsetTime(base)
+		if h.name == weekOfYearMacro && weekStart != time.Monday {
+			return fmt.Sprintf("%02d", weekNumber(offset, weekStart))
 		}
-		return match
+
+		formatter, ok := reg.get(h.name)
+		if !ok {
+			return match
+		}
+		return formatter(offset)
 	})
+}
+
+// weekNumber 按照 weekStart 指定的一周起始日计算 t 在当年的周数（01 起），
+// 以当年第一天所在的周为第 1 周；这与 C 语言 strftime 的 %U/%W 不同，后者把
+// 当年第一个 weekStart 之前的日子记为第 00 周。
+func weekNumber(t time.Time, weekStart time.Weekday) int {
+	yday := t.YearDay()
+	firstOfYear := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	offset := (int(firstOfYear.Weekday()) - int(weekStart) + 7) % 7
+	return (yday+offset-1)/7 + 1
+}
+
+// Formatter 接收已经完成偏移计算的时间，返回宏展开后的文本。
+type Formatter func(t time.Time) string
+
+// FormatterRegistry 持有宏名称到 Formatter 的映射，支持并发读写。
+// 调用方可以通过 Register 覆盖内置宏的输出格式，或者 Unregister 移除某个宏。
+type FormatterRegistry struct {
+	mu         sync.RWMutex
+	formatters map[string]Formatter
+}
+
+// NewFormatterRegistry 返回一个预置了所有内置宏格式的 FormatterRegistry。
+func NewFormatterRegistry() *FormatterRegistry {
+	reg := &FormatterRegistry{formatters: make(map[string]Formatter, len(builtinFormatters))}
+	for name, formatter := range builtinFormatters {
+		reg.formatters[name] = formatter
+	}
+	return reg
+}
+
+// Register 注册或覆盖 name 对应的 Formatter。
+func (r *FormatterRegistry) Register(name string, formatter Formatter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.formatters[name] = formatter
+}
 
-	return result
+// Unregister 移除 name 对应的 Formatter，之后该宏将不再被展开。
+func (r *FormatterRegistry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.formatters, name)
 }
 
+func (r *FormatterRegistry) get(name string) (Formatter, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	formatter, ok := r.formatters[name]
+	return formatter, ok
+}
+
+// defaultFormatterRegistry 是 ExpandTimeMacro 使用的包级别默认注册表。
+var defaultFormatterRegistry = NewFormatterRegistry()
+
+var builtinFormatters = map[string]Formatter{
+	dateHyperMacro:      func(t time.Time) string { return t.Format("2006-01-02") },
+	dateMacro:           func(t time.Time) string { return t.Format("20060102") },
+	hourXMacro:          func(t time.Time) string { return strconv.Itoa(t.Hour()) },
+	hourHHMacro:         func(t time.Time) string { return fmt.Sprintf("%02d", t.Hour()) },
+	dayDDMacro:          func(t time.Time) string { return strconv.Itoa(t.Day()) },
+	monthMacro:          func(t time.Time) string { return fmt.Sprintf("%02d", int(t.Month())) },
+	timestampMacro:      func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	weekOfYearMacro:     func(t time.Time) string { _, w := t.ISOWeek(); return fmt.Sprintf("%02d", w) },
+	weekdayXMacro:       func(t time.Time) string { return strconv.Itoa(int(t.Weekday())) },
+	weekdayNameMacro:    func(t time.Time) string { return t.Weekday().String() },
+	lastDateHyperMacro:  func(t time.Time) string { return t.Format("2006-01-02") },
+	firstDateHyperMacro: func(t time.Time) string { return t.Format("2006-01-02") },
+	lastDateMacro:       func(t time.Time) string { return t.Format("20060102") },
+	firstDateMacro:      func(t time.Time) string { return t.Format("20060102") },
+	lastDayMacro:        func(t time.Time) string { return strconv.Itoa(t.Day()) },
+	firstDayMacro:       func(t time.Time) string { return strconv.Itoa(t.Day()) },
+	nowMacro:            func(t time.Time) string { return t.Format("20060102") },
+	nowHyperMacro:       func(t time.Time) string { return t.Format("2006-01-02") },
+}
+
+const (
+	dateHyperMacro   = "DATE"         // ${DATE} 业务时间日期，格式为:yyyy-mm-dd，如:2015-05-17
+	dateMacro        = "date"         // ${date} 业务时间日期，格式为:yyyymmdd，如:20150526
+	hourXMacro       = "HOUR"         // ${HOUR} 业务时间整点，用于小时级别任务，格式为:x（整数），如：2
+	hourHHMacro      = "hour"         // ${hour} 业务时间整点，用于小时级别任务，格式为:hh，如：02
+	dayDDMacro       = "day"          // ${day} 业务时间日期，用于天级别任务，格式为:x（整数，不补零），如：15
+	monthMacro       = "month"        // ${month} 业务时间月份，用于月级别任务，格式为:mm，如：03
+	timestampMacro   = "timestamp"    // ${timestamp} 业务时间时间戳， 格式为:x（整数），使用前请核对是否符合预期
+	weekOfYearMacro  = "week_of_year" // ${week_of_year} 当前时间是本年的第几周（ISO 8601 周数），格式为:%02d（01~53）
+	weekdayXMacro    = "WEEKDAY"      // ${WEEKDAY} 当前时间是星期几，格式为:x（整数，0~6，0表示周日）
+	weekdayNameMacro = "weekday"      // ${weekday} 当前时间是星期几，格式为英文全称，如：Monday
+
+	lastDateHyperMacro  = "last_DATE"  // ${last_DATE} 业务时间所在月份的最后一天，格式为:yyyy-mm-dd
+	lastDateMacro       = "last_date"  // ${last_date} 业务时间所在月份的最后一天，格式为:yyyymmdd
+	lastDayMacro        = "last_day"   // ${last_day} 业务时间所在月份的最后一天，格式为:dd
+	firstDateHyperMacro = "first_DATE" // ${first_DATE} 业务时间所在月份的第一天，格式为:yyyy-mm-dd
+	firstDateMacro      = "first_date" // ${first_date} 业务时间所在月份的第一天，格式为:yyyymmdd
+	firstDayMacro       = "first_day"  // ${first_day} 业务时间所在月份的第一天，格式为:x（整数），即：1
+
+	nowMacro      = "now" // ${now} 当前时间（ExpandTimeMacroWithOptions 的 opts.Now()），格式为:yyyymmdd
+	nowHyperMacro = "NOW" // ${NOW} 当前时间（ExpandTimeMacroWithOptions 的 opts.Now()），格式为:yyyy-mm-dd
+)
+
+// monthAnchor 表示 last_*/first_* 系列宏的月份锚点：锚点会在月偏移之后、
+// 日/时/秒偏移之前生效，从而让 last_date-1m+2d 这类表达式先定位到目标月份
+// 的最后一天，再继续按天偏移。
+type monthAnchor int
+
 const (
-	dateHyperMacro  = "DATE"         // ${DATE} 业务时间日期，格式为:yyyy-mm-dd，如:2015-05-17
-	dateMacro       = "date"         // ${date} 业务时间日期，格式为:yyyymmdd，如:20150526
-	hourXMacro      = "HOUR"         // ${HOUR} 业务时间整点，用于小时级别任务，格式为:x（整数），如：2
-	hourHHMacro     = "hour"         // ${hour} 业务时间整点，用于小时级别任务，格式为:hh，如：02
-	dayDDMacro      = "day"          // ${day} 业务时间日期，用于天级别任务，格式为:dd，如：15
-	monthMacro      = "month"        // ${month} 业务时间月份，用于月级别任务，格式为:mm，如：03
-	timestampMacro  = "timestamp"    // ${timestamp} 业务时间时间戳， 格式为:x（整数），使用前请核对是否符合预期
-	weekOfYearMacro = "week_of_year" // ${week_of_year} 当前时间是本年的第几周， 格式为:%02d（01~52）
+	anchorNone monthAnchor = iota
+	anchorFirstOfMonth
+	anchorLastOfMonth
 )
 
 const (
 	groupNameVar          = "var"
 	groupNameOffset       = "offset"
 	groupNameOffsetMonth  = "offsetMonth"
+	groupNameOffsetWeek   = "offsetWeek"
 	groupNameOffsetDay    = "offsetDay"
 	groupNameOffsetHour   = "offsetHour"
 	groupNameOffsetSecond = "offsetSecond"
 )
 
-var macroRegex = regexp.MustCompile(`\${(?P<var>DATE|date|hour|day|month|timestamp|week_of_year)(?P<offset>[+\-]\d+)?((?P<offsetMonth>[+\-]\d+)m)?((?P<offsetDay>[+\-]\d+)d)?((?P<offsetHour>[+\-]\d+)h)?((?P<offsetSecond>[+\-]\d+)s)?}`)
+var macroRegex = regexp.MustCompile(`\${(?P<var>DATE|date|HOUR|hour|day|month|timestamp|week_of_year|WEEKDAY|weekday|last_DATE|last_date|last_day|first_DATE|first_date|first_day|now|NOW)(?P<offset>[+\-]\d+)?((?P<offsetMonth>[+\-]\d+)m)?((?P<offsetWeek>[+\-]\d+)w)?((?P<offsetDay>[+\-]\d+)d)?((?P<offsetHour>[+\-]\d+)h)?((?P<offsetSecond>[+\-]\d+)s)?}`)
+
+// fmtMacroRegex 匹配 ${fmt:<layout>} 形式的内联 Go 布局字符串，layout 中除
+// 右花括号"}"和竖线外允许任意字符（包括数字、+/-），偏移后缀必须以"|"分隔书写在
+// layout 之后，如 ${fmt:2006-01-02T15:04:05-0700|+1d}；和 ${nl:expr|fmt:layout}
+// 用"|"分隔表达式与格式是同一个约定。没有这个分隔符，layout 里常见的数字
+// 时区（如 -0700）会被误当成偏移量吞掉。
+var fmtMacroRegex = regexp.MustCompile(`\${fmt:(?P<fmtLayout>[^}|]*)(\|(?P<offset>[+\-]\d+)?((?P<offsetMonth>[+\-]\d+)m)?((?P<offsetWeek>[+\-]\d+)w)?((?P<offsetDay>[+\-]\d+)d)?((?P<offsetHour>[+\-]\d+)h)?((?P<offsetSecond>[+\-]\d+)s)?)?}`)
+
+const groupNameFmtLayout = "fmtLayout"
 
 type macroHandler struct {
 	name         string
 	offset       *int
 	offsetMonth  *int
+	offsetWeek   *int
 	offsetDate   *int
 	offsetHour   *int
 	offsetSecond *int
+	anchor       monthAnchor
 
 	err error
 }
@@ -106,10 +286,18 @@ func parseMacro(match string) (*macroHandler, error) {
 	h := macroHandler{name: macroName}
 	h.offset = h.parseGroup(paramsMap, groupNameOffset)
 	h.offsetMonth = h.parseGroup(paramsMap, groupNameOffsetMonth)
+	h.offsetWeek = h.parseGroup(paramsMap, groupNameOffsetWeek)
 	h.offsetDate = h.parseGroup(paramsMap, groupNameOffsetDay)
 	h.offsetHour = h.parseGroup(paramsMap, groupNameOffsetHour)
 	h.offsetSecond = h.parseGroup(paramsMap, groupNameOffsetSecond)
 
+	switch macroName {
+	case lastDateHyperMacro, lastDateMacro, lastDayMacro:
+		h.anchor = anchorLastOfMonth
+	case firstDateHyperMacro, firstDateMacro, firstDayMacro:
+		h.anchor = anchorFirstOfMonth
+	}
+
 	if h.err != nil {
 		return nil, h.err
 	}
@@ -117,6 +305,36 @@ func parseMacro(match string) (*macroHandler, error) {
 	return &h, nil
 }
 
+func parseFmtMacro(match string) (*macroHandler, string, error) {
+	matches := fmtMacroRegex.FindStringSubmatch(match)
+
+	paramsMap := make(map[string]string)
+	for i, name := range fmtMacroRegex.SubexpNames() {
+		if i > 0 && i <= len(match) {
+			paramsMap[name] = matches[i]
+		}
+	}
+
+	layout, ok := paramsMap[groupNameFmtLayout]
+	if !ok || layout == "" {
+		return nil, "", errors.New("cannot find fmt layout")
+	}
+
+	h := macroHandler{name: dateHyperMacro}
+	h.offset = h.parseGroup(paramsMap, groupNameOffset)
+	h.offsetMonth = h.parseGroup(paramsMap, groupNameOffsetMonth)
+	h.offsetWeek = h.parseGroup(paramsMap, groupNameOffsetWeek)
+	h.offsetDate = h.parseGroup(paramsMap, groupNameOffsetDay)
+	h.offsetHour = h.parseGroup(paramsMap, groupNameOffsetHour)
+	h.offsetSecond = h.parseGroup(paramsMap, groupNameOffsetSecond)
+
+	if h.err != nil {
+		return nil, "", h.err
+	}
+
+	return &h, layout, nil
+}
+
 func (m *macroHandler) parseGroup(paramsMap map[string]string, groupName string) *int {
 	if m.err != nil {
 		return nil
@@ -141,11 +359,11 @@ func (m *macroHandler) parseGroup(paramsMap map[string]string, groupName string)
 func (m *macroHandler) offsetTime(t time.Time) time.Time {
 	if m.offset != nil {
 		switch m.name {
-		case dateMacro, dateHyperMacro, dayDDMacro:
+		case dateMacro, dateHyperMacro, dayDDMacro, weekdayXMacro, weekdayNameMacro, weekOfYearMacro, nowMacro, nowHyperMacro:
 			t = t.AddDate(0, 0, *m.offset)
 		case hourXMacro, hourHHMacro:
 			t = t.Add(time.Duration(*m.offset) * time.Hour)
-		case monthMacro:
+		case monthMacro, lastDateHyperMacro, lastDateMacro, lastDayMacro, firstDateHyperMacro, firstDateMacro, firstDayMacro:
 			t = t.AddDate(0, *m.offset, 0)
 		case timestampMacro:
 			t = t.Add(time.Duration(*m.offset) * time.Second)
@@ -155,6 +373,17 @@ func (m *macroHandler) offsetTime(t time.Time) time.Time {
 	if m.offsetMonth != nil {
 		t = t.AddDate(0, *m.offsetMonth, 0)
 	}
+	if m.offsetWeek != nil {
+		t = t.AddDate(0, 0, 7*(*m.offsetWeek))
+	}
+
+	switch m.anchor {
+	case anchorLastOfMonth:
+		t = time.Date(t.Year(), t.Month()+1, 0, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	case anchorFirstOfMonth:
+		t = time.Date(t.Year(), t.Month(), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	}
+
 	if m.offsetDate != nil {
 		t = t.AddDate(0, 0, *m.offsetDate)
 	}
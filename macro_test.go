@@ -27,4 +27,197 @@ func TestExpandTimeMacro(t *testing.T) {
 		sql := ExpandTimeMacro("select * from table where date = ${DATE}", testTime)
 		require.EqualValues(t, "select * from table where date = 2023-02-28", sql)
 	}
+	{
+		sql := ExpandTimeMacro("select * from table where date = ${date+2w-1d}", testTime)
+		require.EqualValues(t, "select * from table where date = 20230313", sql)
+	}
+}
+
+func TestExpandTimeMacro_WeekOfYear(t *testing.T) {
+	{
+		// 2023-01-01 falls in ISO week 52 of 2022.
+		testTime, err := time.Parse("2006-01-02", "2023-01-01")
+		require.NoError(t, err)
+
+		sql := ExpandTimeMacro("${week_of_year}", testTime)
+		require.EqualValues(t, "52", sql)
+	}
+	{
+		testTime, err := time.Parse("2006-01-02", "2023-02-28")
+		require.NoError(t, err)
+
+		sql := ExpandTimeMacro("${week_of_year}", testTime)
+		require.EqualValues(t, "09", sql)
+	}
+}
+
+func TestExpandTimeMacro_Weekday(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-28")
+	require.NoError(t, err)
+
+	{
+		sql := ExpandTimeMacro("${WEEKDAY}", testTime)
+		require.EqualValues(t, "2", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${weekday}", testTime)
+		require.EqualValues(t, "Tuesday", sql)
+	}
+}
+
+func TestExpandTimeMacro_LastFirstDate(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2019-02-21")
+	require.NoError(t, err)
+
+	{
+		sql := ExpandTimeMacro("${last_DATE}", testTime)
+		require.EqualValues(t, "2019-02-28", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${last_DATE-1}", testTime)
+		require.EqualValues(t, "2019-01-31", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${last_date+1}", testTime)
+		require.EqualValues(t, "20190331", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${last_day}", testTime)
+		require.EqualValues(t, "28", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${first_DATE}", testTime)
+		require.EqualValues(t, "2019-02-01", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${first_day}", testTime)
+		require.EqualValues(t, "1", sql)
+	}
+}
+
+func TestExpandTimeMacro_LastDateLeapYear(t *testing.T) {
+	// 2020 is a leap year, so the last day of February is the 29th.
+	testTime, err := time.Parse("2006-01-02", "2020-02-10")
+	require.NoError(t, err)
+
+	sql := ExpandTimeMacro("${last_DATE}", testTime)
+	require.EqualValues(t, "2020-02-29", sql)
+}
+
+func TestExpandTimeMacro_LastDateYearRollover(t *testing.T) {
+	// -1m crosses into the previous year; last_date should re-anchor to
+	// December's last day.
+	testTime, err := time.Parse("2006-01-02", "2023-01-15")
+	require.NoError(t, err)
+
+	sql := ExpandTimeMacro("${last_date-1m}", testTime)
+	require.EqualValues(t, "20221231", sql)
+}
+
+func TestExpandTimeMacro_LastDateCombinedOffset(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2020-03-15")
+	require.NoError(t, err)
+
+	sql := ExpandTimeMacro("${last_date-1m+2d}", testTime)
+	require.EqualValues(t, "20200302", sql)
+}
+
+func TestExpandTimeMacro_InlineFormat(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-28")
+	require.NoError(t, err)
+
+	{
+		sql := ExpandTimeMacro("${fmt:2006/01/02}", testTime)
+		require.EqualValues(t, "2023/02/28", sql)
+	}
+	{
+		sql := ExpandTimeMacro("${fmt:20060102|+1d}", testTime)
+		require.EqualValues(t, "20230301", sql)
+	}
+	{
+		// A layout ending in a numeric timezone offset must not be mistaken
+		// for an offset suffix now that "|" is required to introduce one.
+		zoned, err := time.Parse(time.RFC3339, "2023-02-28T10:00:00+08:00")
+		require.NoError(t, err)
+
+		sql := ExpandTimeMacro("${fmt:2006-01-02T15:04:05-0700}", zoned)
+		require.EqualValues(t, "2023-02-28T10:00:00+0800", sql)
+	}
+}
+
+func TestExpandTimeMacroWith_FormatterRegistry(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-28")
+	require.NoError(t, err)
+
+	reg := NewFormatterRegistry()
+	reg.Register(dateMacro, func(t time.Time) string { return t.Format("2006/01/02") })
+
+	sql := ExpandTimeMacroWith("select ${date}", testTime, reg)
+	require.EqualValues(t, "select 2023/02/28", sql)
+
+	reg.Unregister(dateMacro)
+	sql = ExpandTimeMacroWith("select ${date}", testTime, reg)
+	require.EqualValues(t, "select ${date}", sql)
+
+	// The package-level default registry is unaffected by a custom one.
+	sql = ExpandTimeMacro("select ${date}", testTime)
+	require.EqualValues(t, "select 20230228", sql)
+}
+
+func TestExpandTimeMacroWithOptions_Location(t *testing.T) {
+	testTime, err := time.Parse(time.RFC3339, "2023-02-28T10:00:00Z")
+	require.NoError(t, err)
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	require.NoError(t, err)
+
+	sql := ExpandTimeMacroWithOptions("${hour}", testTime, Options{Location: shanghai})
+	require.EqualValues(t, "18", sql)
+
+	// Without a Location, the timestamp's own zone (UTC here) is used.
+	sql = ExpandTimeMacro("${hour}", testTime)
+	require.EqualValues(t, "10", sql)
+}
+
+func TestExpandTimeMacroWithOptions_Now(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-28")
+	require.NoError(t, err)
+
+	injected := time.Date(2023, time.May, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{Now: func() time.Time { return injected }}
+
+	sql := ExpandTimeMacroWithOptions("${now} ${NOW} ${date}", testTime, opts)
+	require.EqualValues(t, "20230501 2023-05-01 20230228", sql)
+
+	// Without Options.Now, ${now} falls back to the business time t.
+	sql = ExpandTimeMacro("${now}", testTime)
+	require.EqualValues(t, "20230228", sql)
+}
+
+func TestExpandTimeMacroWithOptions_WeekStart(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-28")
+	require.NoError(t, err)
+
+	// Unset WeekStart (nil) falls back to the ISO default (Monday).
+	sql := ExpandTimeMacroWithOptions("${week_of_year}", testTime, Options{})
+	require.EqualValues(t, "09", sql)
+
+	monday := time.Monday
+	sql = ExpandTimeMacroWithOptions("${week_of_year}", testTime, Options{WeekStart: &monday})
+	require.EqualValues(t, "09", sql)
+}
+
+func TestExpandTimeMacroWithOptions_WeekStartSunday(t *testing.T) {
+	// 2024-01-07 is a Sunday; under a Sunday-start week it already belongs
+	// to week 2, while the ISO (Monday-start) default still counts it as
+	// week 1 (it belongs to the week starting 2024-01-01).
+	testTime, err := time.Parse("2006-01-02", "2024-01-07")
+	require.NoError(t, err)
+
+	sunday := time.Sunday
+	sql := ExpandTimeMacroWithOptions("${week_of_year}", testTime, Options{WeekStart: &sunday})
+	require.EqualValues(t, "02", sql)
+
+	sql = ExpandTimeMacroWithOptions("${week_of_year}", testTime, Options{})
+	require.EqualValues(t, "01", sql)
 }
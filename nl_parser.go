@@ -0,0 +1,444 @@
+package go_time_macro
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNLParse 是自然语言时间表达式解析失败时返回的哨兵错误。expandNLMacro
+// 捕获到该错误后会保留原始的${nl:...}文本，和其它宏遇到非法输入时的容错
+// 行为（parseMacro失败原样返回match）保持一致。
+var errNLParse = errors.New("go-time-macro: cannot parse natural language time expression")
+
+// nlBlockRegex匹配${nl:...}整个代码块，内容为"除}外任意字符"（可以包含
+// "|fmt:"后缀里的竖线），外层的fmtMacroRegex/macroRegex不认识nl前缀，不会互相干扰。
+var nlBlockRegex = regexp.MustCompile(`\$\{nl:(?P<body>[^}]*)\}`)
+
+// nlClockRegex从表达式中提取一个时钟分量：可以是阿拉伯数字小时（可选:分钟、
+// 可选am/pm），也可以是中文数字小时+"点"（可选"分"或"半"）。
+var nlClockRegex = regexp.MustCompile(`(?i)(\d{1,2})(?::(\d{2}))?\s*(am|pm)?|([` + chineseDigits + `]{1,2})点(([` + chineseDigits + `]{1,2})分|半)?`)
+
+const chineseDigits = "一二三四五六七八九十"
+
+var chineseDigitValue = map[rune]int{
+	'一': 1, '二': 2, '三': 3, '四': 4, '五': 5,
+	'六': 6, '七': 7, '八': 8, '九': 9, '十': 10,
+}
+
+// nlHandler是自然语言表达式解析后的中间结果，字段含义与macroHandler对齐：
+// dayOffset是相对业务时间t的天数偏移，weekday/weekdayModifier用于"下周四"/
+// "next monday"这类按星期定位的表达式，hour/minute是可选的具体时刻。
+// "last day of month"这类整体短语在evalNLExpr里单独处理，不经过tokenizeNL。
+type nlHandler struct {
+	dayOffset int
+	// hasDayOffset区分"显式命中了相对天数词"和"dayOffset取零值"，避免"今天"
+	// (offset=0)被误判为没有识别到任何词，和hasWeekday的作用一致。
+	hasDayOffset    bool
+	hasWeekday      bool
+	weekday         time.Weekday
+	weekdayModifier nlWeekdayModifier
+	hour            *int
+	minute          *int
+	// pendingPeriodBias暂存"下午/晚上"这类时段词的+12小时偏移：当时段词先于
+	// 具体小时出现（如"下午三点"）时，小时还未解析出来，先记在这里，等
+	// applyNLClock解析出小时后再叠加。
+	pendingPeriodBias int
+}
+
+type nlWeekdayModifier int
+
+const (
+	nlWeekdayNearest nlWeekdayModifier = iota // 未指定next/last时，命中从今天起往后（含今天）最近的一次
+	nlWeekdayNext
+	nlWeekdayLast
+)
+
+// NLKeywordHandler在自然语言解析命中某个关键字时被调用，用于在nlHandler上
+// 记录解析结果；注册到RegisterNLKeyword的词语使用方可以借此扩展词表。
+type NLKeywordHandler func(h *nlHandler)
+
+var (
+	nlKeywordsMu sync.RWMutex
+	// nlKeywords以lang为一级key（如"zh"、"en"），word为二级key，保存自定义
+	// 关键字；内置词表见nlDayKeywords等变量，不经过这张表。
+	nlKeywords = map[string]map[string]NLKeywordHandler{}
+)
+
+// RegisterNLKeyword为${nl:...}解析器注册一个自定义关键字，lang是词语所属的
+// 语言标签（仅用于分组管理，解析时不区分lang直接按word匹配），word是要识别
+// 的原始文本（不区分大小写，中文词语原样匹配），handler在命中该词语时被调用，
+// 用于修改nlHandler记录的解析结果。
+func RegisterNLKeyword(lang, word string, handler NLKeywordHandler) {
+	nlKeywordsMu.Lock()
+	defer nlKeywordsMu.Unlock()
+
+	if nlKeywords[lang] == nil {
+		nlKeywords[lang] = make(map[string]NLKeywordHandler)
+	}
+	nlKeywords[lang][word] = handler
+}
+
+// nlDayKeywords是相对天数的内置词表；nlWordCandidates会把所有词按长度降序
+// 排列，保证"大后天"优先于"后天"被匹配到。
+var nlDayKeywords = []struct {
+	word   string
+	offset int
+}{
+	{"大后天", 3},
+	{"后天", 2},
+	{"明天", 1},
+	{"今天", 0},
+	{"昨天", -1},
+	{"前天", -2},
+	{"tomorrow", 1},
+	{"today", 0},
+	{"yesterday", -1},
+}
+
+var nlWeekdayKeywords = []struct {
+	word    string
+	weekday time.Weekday
+}{
+	{"星期一", time.Monday}, {"星期二", time.Tuesday}, {"星期三", time.Wednesday},
+	{"星期四", time.Thursday}, {"星期五", time.Friday}, {"星期六", time.Saturday},
+	{"星期日", time.Sunday}, {"星期天", time.Sunday},
+	// "每周X"整体作为一个词识别，避免"每周"与"周X"的"周"字重叠冲突。
+	{"每周一", time.Monday}, {"每周二", time.Tuesday}, {"每周三", time.Wednesday},
+	{"每周四", time.Thursday}, {"每周五", time.Friday}, {"每周六", time.Saturday},
+	{"每周日", time.Sunday}, {"每周天", time.Sunday},
+	{"周一", time.Monday}, {"周二", time.Tuesday}, {"周三", time.Wednesday},
+	{"周四", time.Thursday}, {"周五", time.Friday}, {"周六", time.Saturday},
+	{"周日", time.Sunday}, {"周天", time.Sunday},
+	{"monday", time.Monday}, {"tuesday", time.Tuesday}, {"wednesday", time.Wednesday},
+	{"thursday", time.Thursday}, {"friday", time.Friday}, {"saturday", time.Saturday},
+	{"sunday", time.Sunday},
+	{"mon", time.Monday}, {"tue", time.Tuesday}, {"wed", time.Wednesday},
+	{"thu", time.Thursday}, {"fri", time.Friday}, {"sat", time.Saturday}, {"sun", time.Sunday},
+}
+
+var nlWeekdayModifierKeywords = []struct {
+	word     string
+	modifier nlWeekdayModifier
+}{
+	{"下周", nlWeekdayNext}, {"下个", nlWeekdayNext}, {"next", nlWeekdayNext},
+	{"上周", nlWeekdayLast}, {"上个", nlWeekdayLast}, {"last", nlWeekdayLast},
+}
+
+// nlPeriodKeywords是上午/下午一类的时段词，命中后会在hour落在1~12范围时
+// 施加偏移（下午/晚上场景+12小时）。1~11点时与"${nl:tomorrow 3pm}"里am/pm的
+// 效果一致；12点同样会叠加+12小时，得到24点即次日0点，而"12pm"仍是12点。
+var nlPeriodKeywords = []struct {
+	word string
+	bias int
+}{
+	{"上午", 0}, {"早上", 0}, {"凌晨", 0}, {"morning", 0},
+	{"下午", 12}, {"晚上", 12}, {"afternoon", 12}, {"evening", 12}, {"noon", 12},
+}
+
+const nlLastDayOfMonthPhrase = "last day of month"
+
+// expandNLMacro展开sql中所有${nl:...}代码块，t是宏展开使用的业务时间。
+func expandNLMacro(rawSQL string, t time.Time) string {
+	return nlBlockRegex.ReplaceAllStringFunc(rawSQL, func(match string) string {
+		groups := nlBlockRegex.FindStringSubmatch(match)
+		body := groups[1]
+
+		expr, layout := splitNLFormat(body)
+
+		result, err := evalNLExpr(expr, t)
+		if err != nil {
+			return match
+		}
+
+		if layout != "" {
+			return result.Format(layout)
+		}
+		return result.Format("2006-01-02")
+	})
+}
+
+// splitNLFormat把"<表达式>|fmt:<layout>"拆成表达式本体和显式输出格式，没有
+// "|fmt:"后缀时layout为空串，由调用方套用默认格式。
+func splitNLFormat(body string) (expr, layout string) {
+	expr = body
+	if idx := strings.LastIndex(body, "|"); idx >= 0 {
+		suffix := strings.TrimSpace(body[idx+1:])
+		if strings.HasPrefix(suffix, "fmt:") {
+			expr = body[:idx]
+			layout = strings.TrimPrefix(suffix, "fmt:")
+		}
+	}
+	return strings.TrimSpace(expr), layout
+}
+
+// evalNLExpr解析expr并以t为锚点计算出目标时间。
+func evalNLExpr(expr string, t time.Time) (time.Time, error) {
+	if strings.EqualFold(strings.TrimSpace(expr), nlLastDayOfMonthPhrase) {
+		h := macroHandler{name: lastDateHyperMacro, anchor: anchorLastOfMonth}
+		return h.offsetTime(t), nil
+	}
+
+	h, err := tokenizeNL(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	result := t
+	switch {
+	case h.hasWeekday:
+		result = nextWeekday(t, h.weekday, h.weekdayModifier)
+	case h.hasDayOffset:
+		result = t.AddDate(0, 0, h.dayOffset)
+	}
+
+	if h.hour != nil {
+		minute := 0
+		if h.minute != nil {
+			minute = *h.minute
+		}
+		result = time.Date(result.Year(), result.Month(), result.Day(), *h.hour, minute, 0, 0, result.Location())
+	}
+
+	return result, nil
+}
+
+// nextWeekday以base为锚点，按modifier的语义定位到离base最近的target星期几：
+// nlWeekdayNext往后找（不含今天），nlWeekdayLast往前找（不含今天），
+// nlWeekdayNearest是从今天起往后（含今天）最近的一次，可能落在下一周
+// （今天就是target时返回今天）。
+func nextWeekday(base time.Time, target time.Weekday, modifier nlWeekdayModifier) time.Time {
+	switch modifier {
+	case nlWeekdayLast:
+		diff := (int(base.Weekday()) - int(target) + 7) % 7
+		if diff == 0 {
+			diff = 7
+		}
+		return base.AddDate(0, 0, -diff)
+	default:
+		diff := (int(target) - int(base.Weekday()) + 7) % 7
+		if modifier == nlWeekdayNext && diff == 0 {
+			diff = 7
+		}
+		return base.AddDate(0, 0, diff)
+	}
+}
+
+// tokenizeNL扫描expr，识别相对天数、星期几（及next/last修饰）、时段与具体
+// 时刻等固定词汇，按从左到右的顺序逐个消费；未识别的字符（空格、标点等）
+// 会被跳过。
+//
+// 一个表达式只有在锚定到具体的某一天时才算解析成功：必须命中相对天数词或
+// 星期几词（h.hasDayOffset或h.hasWeekday）。孤立的时钟分量（比如"order id
+// 12345"里的"12"）或孤立的next/last修饰词（比如"last day"里的"last"，
+// 没有搭配星期几）都不足以构成一个完整的表达式，即使各自都"匹配"到了输入
+// 里的某个子串，也必须判定为解析失败，保留原始的${nl:...}文本。
+func tokenizeNL(expr string) (*nlHandler, error) {
+	h := &nlHandler{weekdayModifier: nlWeekdayNearest}
+
+	runes := []rune(expr)
+	lower := []rune(strings.ToLower(expr))
+	candidates := nlWordCandidates()
+
+	for i := 0; i < len(runes); {
+		if m := nlClockRegex.FindStringSubmatch(string(runes[i:])); m != nil && strings.HasPrefix(string(runes[i:]), m[0]) {
+			if consumed := applyNLClock(h, m); consumed > 0 {
+				i += consumed
+				continue
+			}
+		}
+
+		if _, handler, n := matchNLWord(lower, i, candidates); n > 0 {
+			handler(h)
+			i += n
+			continue
+		}
+
+		i++
+	}
+
+	if !h.hasDayOffset && !h.hasWeekday {
+		return nil, errNLParse
+	}
+	return h, nil
+}
+
+// matchNLWord在lower（已转小写的rune序列）的位置i尝试从candidates中匹配一个
+// 词语，返回命中词语对应的处理函数和消费的rune数。英文词语要求左右两侧都
+// 不是字母/数字边界，避免"tue"误匹配"statue"、"mon"误匹配"monday"中的子串。
+func matchNLWord(lower []rune, i int, candidates []nlWordCandidate) (string, NLKeywordHandler, int) {
+	for _, c := range candidates {
+		wr := []rune(c.word)
+		if i+len(wr) > len(lower) {
+			continue
+		}
+		if string(lower[i:i+len(wr)]) != c.word {
+			continue
+		}
+		if isASCIIWord(c.word) {
+			if i > 0 && isASCIIAlnum(lower[i-1]) {
+				continue
+			}
+			if i+len(wr) < len(lower) && isASCIIAlnum(lower[i+len(wr)]) {
+				continue
+			}
+		}
+		return c.word, c.handler, len(wr)
+	}
+
+	return "", nil, 0
+}
+
+type nlWordCandidate struct {
+	word    string
+	handler NLKeywordHandler
+}
+
+// nlWordCandidates把内置词表和用户通过RegisterNLKeyword注册的词语合并成
+// 一份按词长降序排列的列表，保证更长的词（如"大后天"）优先于更短的词
+// （如"后天"）被匹配。
+func nlWordCandidates() []nlWordCandidate {
+	var candidates []nlWordCandidate
+
+	for _, d := range nlDayKeywords {
+		offset := d.offset
+		candidates = append(candidates, nlWordCandidate{strings.ToLower(d.word), func(h *nlHandler) {
+			h.hasDayOffset = true
+			h.dayOffset = offset
+		}})
+	}
+	for _, w := range nlWeekdayKeywords {
+		weekday := w.weekday
+		candidates = append(candidates, nlWordCandidate{strings.ToLower(w.word), func(h *nlHandler) {
+			h.hasWeekday = true
+			h.weekday = weekday
+		}})
+	}
+	for _, m := range nlWeekdayModifierKeywords {
+		modifier := m.modifier
+		candidates = append(candidates, nlWordCandidate{strings.ToLower(m.word), func(h *nlHandler) { h.weekdayModifier = modifier }})
+	}
+	// "下周X"/"上周X"整体作为一个词识别，否则"下周"/"上周"会先吞掉"周X"里的"周"字。
+	for _, w := range nlWeekdayKeywords {
+		if !strings.HasPrefix(w.word, "周") {
+			continue
+		}
+		for prefix, modifier := range map[string]nlWeekdayModifier{"下": nlWeekdayNext, "上": nlWeekdayLast} {
+			weekday, modifier := w.weekday, modifier
+			candidates = append(candidates, nlWordCandidate{prefix + w.word, func(h *nlHandler) {
+				h.hasWeekday, h.weekday, h.weekdayModifier = true, weekday, modifier
+			}})
+		}
+	}
+	for _, p := range nlPeriodKeywords {
+		bias := p.bias
+		candidates = append(candidates, nlWordCandidate{strings.ToLower(p.word), func(h *nlHandler) { applyNLPeriodBias(h, bias) }})
+	}
+
+	nlKeywordsMu.RLock()
+	for _, words := range nlKeywords {
+		for word, handler := range words {
+			candidates = append(candidates, nlWordCandidate{strings.ToLower(word), handler})
+		}
+	}
+	nlKeywordsMu.RUnlock()
+
+	sortByWordLenDesc(candidates)
+	return candidates
+}
+
+func sortByWordLenDesc(candidates []nlWordCandidate) {
+	for i := 1; i < len(candidates); i++ {
+		for j := i; j > 0 && len([]rune(candidates[j-1].word)) < len([]rune(candidates[j].word)); j-- {
+			candidates[j-1], candidates[j] = candidates[j], candidates[j-1]
+		}
+	}
+}
+
+// applyNLPeriodBias把下午/晚上一类时段词的+12小时偏移叠加到已经识别出的
+// 小时上；如果时段词出现在小时之前（如"下午三点"），解析仍会先匹配到
+// 时段词、再匹配到小时，此时h.hour还是nil，偏移量记在h.pendingPeriodBias。
+func applyNLPeriodBias(h *nlHandler, bias int) {
+	if h.hour != nil && *h.hour >= 1 && *h.hour <= 12 {
+		v := *h.hour + bias
+		h.hour = &v
+		return
+	}
+	h.pendingPeriodBias = bias
+}
+
+// applyNLClock解析nlClockRegex命中的时钟分量，写入h.hour/h.minute，返回
+// 消费掉的字符数（0表示本次匹配不是一个真正的时钟分量，比如误配到了空串）。
+func applyNLClock(h *nlHandler, m []string) int {
+	if m == nil {
+		return 0
+	}
+
+	switch {
+	case m[1] != "": // 阿拉伯数字小时
+		hour, _ := strconv.Atoi(m[1])
+		switch {
+		case strings.EqualFold(m[3], "pm") && hour < 12:
+			hour += 12
+		case strings.EqualFold(m[3], "am") && hour == 12:
+			hour = 0
+		}
+		minute := 0
+		if m[2] != "" {
+			minute, _ = strconv.Atoi(m[2])
+		}
+		setNLClock(h, hour, minute)
+		return len([]rune(m[0]))
+	case m[4] != "": // 中文数字小时+"点"
+		hour := chineseDigitsToInt(m[4])
+		minute := 0
+		if m[6] != "" {
+			minute = chineseDigitsToInt(m[6])
+		} else if m[5] == "半" {
+			minute = 30
+		}
+		setNLClock(h, hour, minute)
+		return len([]rune(m[0]))
+	default:
+		return 0
+	}
+}
+
+func setNLClock(h *nlHandler, hour, minute int) {
+	if h.pendingPeriodBias != 0 && hour >= 1 && hour <= 12 {
+		hour += h.pendingPeriodBias
+		h.pendingPeriodBias = 0
+	}
+	h.hour = &hour
+	h.minute = &minute
+}
+
+func chineseDigitsToInt(s string) int {
+	runes := []rune(s)
+	if len(runes) == 1 {
+		return chineseDigitValue[runes[0]]
+	}
+	if runes[0] == '十' { // 十一~十九
+		return 10 + chineseDigitValue[runes[1]]
+	}
+	if runes[1] == '十' { // 二十、三十、……、五十
+		return chineseDigitValue[runes[0]] * 10
+	}
+	return chineseDigitValue[runes[0]]*10 + chineseDigitValue[runes[1]]
+}
+
+func isASCIIWord(s string) bool {
+	for _, r := range s {
+		if r > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCIIAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
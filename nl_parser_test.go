@@ -0,0 +1,70 @@
+package go_time_macro
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandTimeMacro_NaturalLanguage(t *testing.T) {
+	// 2023-02-22 is a Wednesday.
+	testTime, err := time.Parse("2006-01-02", "2023-02-22")
+	require.NoError(t, err)
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{"${nl:明天下午三点|fmt:2006-01-02 15:04}", "2023-02-23 15:00"},
+		{"${nl:大后天 16:00|fmt:2006-01-02 15:04}", "2023-02-25 16:00"},
+		{"${nl:tomorrow 3pm|fmt:2006-01-02 15:04}", "2023-02-23 15:00"},
+		{"${nl:next monday}", "2023-02-27"},
+		{"${nl:last monday}", "2023-02-20"},
+		{"${nl:last day of month}", "2023-02-28"},
+		{"${nl:每周四}", "2023-02-23"},
+		{"${nl:昨天}", "2023-02-21"},
+		// "今天" has a zero day offset; it must still count as a recognized
+		// expression rather than being indistinguishable from "no match".
+		{"${nl:今天}", "2023-02-22"},
+	}
+
+	for _, c := range cases {
+		require.EqualValues(t, c.want, ExpandTimeMacro(c.expr, testTime), c.expr)
+	}
+}
+
+func TestExpandTimeMacro_NaturalLanguageInvalidLeftIntact(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-22")
+	require.NoError(t, err)
+
+	exprs := []string{
+		"${nl:bogus expression !!!}",
+		// A bare 1-2 digit number with no accompanying day/weekday keyword is
+		// not a time expression on its own; it must not be mistaken for an
+		// hour and silently turned into "today at that hour".
+		"${nl:order id 12345}",
+		"${nl:v2 release}",
+		// A lone next/last modifier with no weekday attached (distinct from
+		// the whole "last day of month" phrase) must not resolve to today.
+		"${nl:last day}",
+	}
+
+	for _, expr := range exprs {
+		sql := ExpandTimeMacro("select * from t where d = "+expr, testTime)
+		require.EqualValues(t, "select * from t where d = "+expr, sql, expr)
+	}
+}
+
+func TestRegisterNLKeyword(t *testing.T) {
+	testTime, err := time.Parse("2006-01-02", "2023-02-22")
+	require.NoError(t, err)
+
+	RegisterNLKeyword("zh", "大大后天", func(h *nlHandler) {
+		h.hasDayOffset = true
+		h.dayOffset = 4
+	})
+
+	sql := ExpandTimeMacro("${nl:大大后天}", testTime)
+	require.EqualValues(t, "2023-02-26", sql)
+}